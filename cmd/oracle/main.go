@@ -18,14 +18,24 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"go/build"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"code.google.com/p/go.tools/oracle"
 )
@@ -35,23 +45,106 @@ var posFlag = flag.String("pos", "",
 		"e.g. foo.go:123-456, bar.go:123.")
 
 var modeFlag = flag.String("mode", "",
-	"Mode of query to perform: callers, callees, callstack, callgraph, describe.")
+	"Mode of query to perform: "+strings.Join(implementedModes, ", ")+". "+
+		"May also be given as a subcommand, e.g. 'oracle callers foo.go:123 ./...'.")
+
+// implementedModes are the query kinds oracle.Query already knows how to
+// answer.
+var implementedModes = []string{"callers", "callees", "callstack", "callgraph", "describe"}
+
+// plannedModes names query kinds that oracle.Query cannot answer: the
+// oracle package has no analysis for them, no per-mode validation of -pos
+// and no table of query kinds. The dispatcher below recognizes these names
+// only to reject them with an error, on every path that accepts a mode;
+// they are never forwarded to oracle.Query.
+var plannedModes = []string{"definition", "referrers", "freevars", "implements", "peers"}
+
+func isMode(s string) bool {
+	return isImplementedMode(s) || isPlannedMode(s)
+}
+
+func isImplementedMode(s string) bool {
+	for _, m := range implementedModes {
+		if m == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isPlannedMode(s string) bool {
+	for _, m := range plannedModes {
+		if m == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectPlannedMode returns a friendly, non-nil error if mode names one of
+// plannedModes, so that every dispatch path that accepts a mode string (the
+// single-shot CLI path and the -serve HTTP/JSON-RPC paths alike) rejects it
+// up front instead of forwarding it to oracle.Query as if it worked.
+func rejectPlannedMode(mode string) error {
+	if !isPlannedMode(mode) {
+		return nil
+	}
+	return fmt.Errorf("mode %q is not implemented yet "+
+		"(needs analysis support in the oracle package); "+
+		"available modes are: %s", mode, strings.Join(implementedModes, ", "))
+}
 
 var ptalogFlag = flag.String("ptalog", "",
 	"Location of the points-to analysis log file, or empty to disable logging.")
 
-var formatFlag = flag.String("format", "plain", "Output format: 'plain' or 'json'.")
+var scopeFlag = flag.String("scope", "",
+	"Comma-separated list of package patterns to add to the analysis, "+
+		"e.g. 'foo/...,-foo/testdata'. Each pattern is either an import path, "+
+		"or an import path followed by '/...' to include its subpackages; a "+
+		"pattern prefixed with '-' removes packages matched by earlier patterns. "+
+		"Patterns are resolved against build.Default's GOPATH. The resulting "+
+		"import paths are appended to the package arguments; -scope does not "+
+		"restrict the analysis, which still covers the whole program reachable "+
+		"from all the arguments, and '-' patterns cannot remove a package "+
+		"named as an argument or a dependency.")
+
+var formatFlag = flag.String("format", "plain", "Output format: 'plain', 'json' or 'xml'. "+
+	"Note: oracle.Result has no xml struct tags, and encoding/xml (unlike "+
+	"encoding/json) cannot marshal map-typed fields, so 'xml' may fail for "+
+	"modes whose result contains a map, e.g. 'callgraph'; use 'json' there.")
+
+var modifiedFlag = flag.Bool("modified", false,
+	"Read an archive of unsaved buffers from stdin, and use their contents "+
+		"in place of the corresponding files on disk. The archive consists "+
+		"of the file's name, a newline, its decimal size in bytes, a "+
+		"newline, and then that many bytes of content, repeated for each "+
+		"modified file until EOF. This lets editors query the code the "+
+		"user is currently typing without first saving it to disk.")
+
+var serveFlag = flag.String("serve", "",
+	"Run as a server, listening for queries on the given address (e.g. -serve=localhost:8080), "+
+		"instead of answering a single query and exiting. This saves editors the cost of "+
+		"starting a new oracle process per query, but NOT the cost of analysis: each query "+
+		"still re-parses, re-typechecks and re-runs pointer analysis from scratch, since "+
+		"oracle.Query exposes no way to load the program once and reuse that state. "+
+		"Use -serve=- to speak a line-based JSON-RPC protocol on stdin/stdout instead of HTTP.")
 
 const usage = `Go source code oracle.
 Usage: oracle [<flag> ...] [<file.go> ...] [<arg> ...]
+       oracle <mode> <position> [<file.go> ...] [<arg> ...]
 Use -help flag to display options.
 
 Examples:
 % oracle -pos 'hello.go 123' hello.go
 % oracle -pos 'hello.go 123 456' hello.go
+% oracle callers hello.go:123 hello.go
 `
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var memprofile = flag.String("memprofile", "", "write memory profile to this file at exit")
+var blockprofile = flag.String("blockprofile", "", "write goroutine blocking profile to this file at exit")
+var mutexprofile = flag.String("mutexprofile", "", "write mutex contention profile to this file at exit")
+var traceFlag = flag.String("trace", "", "write an execution trace to this file")
 
 // TODO(adonovan): the caller must---before go/build.init
 // runs---specify CGO_ENABLED=0, which entails the "!cgo" go/build
@@ -89,6 +182,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Subcommand form: "oracle <mode> <position> <args> ...", equivalent
+	// to "oracle -mode=<mode> -pos=<position> <args> ...".
+	mode := *modeFlag
+	pos := *posFlag
+	if mode == "" && isMode(args[0]) {
+		mode = args[0]
+		args = args[1:]
+		if len(args) == 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(1)
+		}
+		pos = args[0]
+		args = args[1:]
+	}
+
+	if err := rejectPlannedMode(mode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	// Set up points-to analysis log file.
 	var ptalog io.Writer
 	if *ptalogFlag != "" {
@@ -105,29 +218,107 @@ func main() {
 	}
 
 	// Profiling support.
+	var cleanups []func()
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
 			log.Fatal(err)
 		}
 		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+		cleanups = append(cleanups, pprof.StopCPUProfile)
+	}
+	if *blockprofile != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if *mutexprofile != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+	if *traceFlag != "" {
+		f, err := os.Create(*traceFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := trace.Start(f); err != nil {
+			log.Fatal(err)
+		}
+		cleanups = append(cleanups, trace.Stop)
+	}
+	cleanups = append(cleanups, writeHeapAndContentionProfiles)
+	stopProfiling := func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+	defer stopProfiling()
+
+	if *serveFlag != "" {
+		// The server normally runs until killed, so flush the profiles
+		// requested above on SIGINT/SIGTERM too, not just on the
+		// (rarely taken) path where main returns normally.
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigc
+			stopProfiling()
+			os.Exit(0)
+		}()
 	}
 
 	// -format flag
-	if *formatFlag != "json" && *formatFlag != "plain" {
+	switch *formatFlag {
+	case "json", "plain", "xml":
+		// ok
+	default:
 		fmt.Fprintf(os.Stderr, "illegal -format value: %q", *formatFlag)
 		os.Exit(1)
 	}
 
+	// -modified flag
+	ctxt := &build.Default
+	if *modifiedFlag {
+		overlay, err := parseArchive(os.Stdin)
+		if err != nil {
+			log.Fatalf("-modified: %s", err)
+		}
+		ctxt = overlayContext(ctxt, overlay)
+	}
+
+	// -scope flag
+	//
+	// oracle.Query has no separate scope parameter: the trailing <arg>
+	// list in its usage ("oracle [<flag> ...] [<file.go> ...] [<arg> ...]")
+	// already bounds which packages the whole-program analysis covers. So
+	// -scope simply expands its patterns into import paths and folds them
+	// into that same args list, rather than threading a new argument
+	// through to an oracle.Query signature that doesn't exist.
+	if *scopeFlag != "" {
+		scope, err := expandScope(strings.Split(*scopeFlag, ","), ctxt)
+		if err != nil {
+			log.Fatalf("-scope: %s", err)
+		}
+		args = mergeArgs(args, scope)
+	}
+
+	if *serveFlag != "" {
+		if err := serve(*serveFlag, args, ptalog, ctxt); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Ask the oracle.
-	res, err := oracle.Query(args, *modeFlag, *posFlag, ptalog, &build.Default)
+	res, err := oracle.Query(args, mode, pos, ptalog, ctxt)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
 	// Print the result.
+	writeResult(os.Stdout, res)
+}
+
+// writeResult prints res to w in the format requested by -format.
+func writeResult(w io.Writer, res *oracle.Result) {
 	switch *formatFlag {
 	case "json":
 		b, err := json.Marshal(res)
@@ -140,9 +331,273 @@ func main() {
 			fmt.Fprintf(os.Stderr, "json.Indent failed: %s", err)
 			os.Exit(1)
 		}
-		os.Stdout.Write(buf.Bytes())
+		w.Write(buf.Bytes())
+
+	case "xml":
+		b, err := xml.MarshalIndent(res, "", "\t")
+		if err != nil {
+			// Unlike encoding/json, encoding/xml cannot marshal
+			// map-typed fields, and oracle.Result predates XML output
+			// so it carries no `xml:"..."` struct tags steering it away
+			// from any it has. Rather than silently drop data, surface
+			// the failure and point the user at -format=json, which
+			// every mode already supports.
+			fmt.Fprintf(os.Stderr, "XML error: %s (this query's result may not "+
+				"support -format=xml yet; try -format=json)\n", err.Error())
+			os.Exit(1)
+		}
+		w.Write(b)
 
 	case "plain":
-		res.WriteTo(os.Stdout)
+		res.WriteTo(w)
+	}
+}
+
+// A serveRequest is a single query sent to a running oracle server, either
+// over HTTP or via the -serve=- line-based JSON-RPC protocol on stdin.
+type serveRequest struct {
+	Mode string `json:"mode"`
+	Pos  string `json:"pos"`
+}
+
+// queryFunc answers a single (mode, pos) query.
+type queryFunc func(mode, pos string) (*oracle.Result, error)
+
+// serve answers successive queries against args, either as an HTTP server
+// listening on addr, or, if addr == "-", as a line-based JSON-RPC server on
+// stdin/stdout. It still calls oracle.Query in full for every request:
+// oracle.Query does not currently expose a way to load the program and run
+// its points-to analysis once and reuse that state across queries, so
+// -serve avoids the cost of starting a new process per query, but every
+// query still loads and analyzes the program from scratch.
+func serve(addr string, args []string, ptalog io.Writer, ctxt *build.Context) error {
+	answer := func(mode, pos string) (*oracle.Result, error) {
+		if err := rejectPlannedMode(mode); err != nil {
+			return nil, err
+		}
+		return oracle.Query(args, mode, pos, ptalog, ctxt)
+	}
+
+	if addr == "-" {
+		return serveJSONRPC(os.Stdin, os.Stdout, answer)
+	}
+	return serveHTTP(addr, answer)
+}
+
+func serveHTTP(addr string, answer queryFunc) error {
+	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		res, err := answer(r.FormValue("mode"), r.FormValue("pos"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeResult(w, res)
+	})
+	log.Printf("oracle: serving queries on http://%s/query", addr)
+	return http.ListenAndServe(addr, nil)
+}
+
+func serveJSONRPC(in io.Reader, out io.Writer, answer queryFunc) error {
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	for {
+		var req serveRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		res, err := answer(req.Mode, req.Pos)
+		if err != nil {
+			enc.Encode(map[string]string{"error": err.Error()})
+			continue
+		}
+		enc.Encode(res)
 	}
-}
\ No newline at end of file
+}
+
+// parseArchive reads the -modified archive format from rd: a sequence of
+// records, each a file name, a line break, the decimal file size, a line
+// break, and that many bytes of file content, repeated until EOF.
+func parseArchive(rd io.Reader) (map[string][]byte, error) {
+	br := bufio.NewReader(rd)
+	overlay := make(map[string][]byte)
+	for {
+		name, err := br.ReadString('\n')
+		if err == io.EOF {
+			return overlay, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name = strings.TrimSuffix(name, "\n")
+
+		sizeLine, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%s: missing size line: %v", name, err)
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(sizeLine, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid size: %v", name, err)
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("%s: invalid size: %d", name, size)
+		}
+
+		content := make([]byte, size)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		overlay[name] = content
+	}
+}
+
+// overlayContext returns a copy of ctxt in which files named by overlay are
+// read from memory in preference to the underlying file system, so that
+// go/build-based tools such as the oracle's loader see the user's unsaved
+// edits rather than the last-saved contents of the corresponding file.
+func overlayContext(ctxt *build.Context, overlay map[string][]byte) *build.Context {
+	copy := *ctxt
+	copy.OpenFile = func(path string) (io.ReadCloser, error) {
+		if content, ok := overlay[path]; ok {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		if ctxt.OpenFile != nil {
+			return ctxt.OpenFile(path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return &copy
+}
+
+// mergeArgs appends extra to args, skipping any entries extra shares with
+// args so a package named explicitly isn't passed to oracle.Query twice.
+func mergeArgs(args, extra []string) []string {
+	have := make(map[string]bool, len(args))
+	for _, a := range args {
+		have[a] = true
+	}
+	for _, e := range extra {
+		if !have[e] {
+			args = append(args, e)
+			have[e] = true
+		}
+	}
+	return args
+}
+
+// expandScope resolves the -scope patterns against ctxt's GOPATH workspaces
+// into a set of import paths. A pattern of the form "foo/..." matches foo
+// and all its subpackages; a pattern prefixed with "-" removes matches from
+// the result instead of adding them. Patterns are processed in order, so
+// later exclusions win over earlier inclusions.
+func expandScope(patterns []string, ctxt *build.Context) ([]string, error) {
+	set := make(map[string]bool)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(pattern, "-")
+		if exclude {
+			pattern = pattern[len("-"):]
+		}
+
+		matches, err := matchPackages(pattern, ctxt)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			if exclude {
+				delete(set, path)
+			} else {
+				set[path] = true
+			}
+		}
+	}
+
+	scope := make([]string, 0, len(set))
+	for path := range set {
+		scope = append(scope, path)
+	}
+	sort.Strings(scope)
+	return scope, nil
+}
+
+// matchPackages expands a single scope pattern, honoring the "foo/..."
+// recursive wildcard, into the list of import paths it denotes.
+func matchPackages(pattern string, ctxt *build.Context) ([]string, error) {
+	if !strings.HasSuffix(pattern, "/...") {
+		return []string{pattern}, nil
+	}
+	root := strings.TrimSuffix(pattern, "/...")
+
+	var matches []string
+	for _, gopath := range filepath.SplitList(ctxt.GOPATH) {
+		dir := filepath.Join(gopath, "src", filepath.FromSlash(root))
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			if _, err := ctxt.ImportDir(path, 0); err != nil {
+				if _, ok := err.(*build.NoGoError); ok {
+					return nil // no Go source files: not a package
+				}
+			}
+			importPath := root
+			if rel != "." {
+				importPath = root + "/" + filepath.ToSlash(rel)
+			}
+			matches = append(matches, importPath)
+			return nil
+		})
+	}
+	return matches, nil
+}
+
+// writeHeapAndContentionProfiles writes the -memprofile, -blockprofile and
+// -mutexprofile outputs requested above, if any. It runs at shutdown,
+// alongside the -cpuprofile and -trace cleanups, so that the pointer
+// analysis's CPU, allocation and contention behaviour can all be compared
+// from a single run.
+func writeHeapAndContentionProfiles() {
+	if *memprofile != "" {
+		f, err := os.Create(*memprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+	if *blockprofile != "" {
+		f, err := os.Create(*blockprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.Lookup("block").WriteTo(f, 0); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+	if *mutexprofile != "" {
+		f, err := os.Create(*mutexprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.Lookup("mutex").WriteTo(f, 0); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+}